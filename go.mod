@@ -2,7 +2,10 @@ module github.com/birddigital/rod-mcp-server
 
 go 1.21
 
-require github.com/go-rod/rod v0.116.2
+require (
+	github.com/go-rod/rod v0.116.2
+	github.com/go-rod/stealth v0.4.9
+)
 
 require (
 	github.com/ysmood/fetchup v0.2.4 // indirect
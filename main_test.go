@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+func TestJSFunctionCandidates(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"document.title", "() => (\ndocument.title\n)"},
+		{"document.title;", "() => (\ndocument.title\n)"},
+		{"(a, b) => a + b", "(a, b) => a + b"},
+		{"document.title // page title", "() => (\ndocument.title // page title\n)"},
+		{`location.href.replace(/^https?:\/\//, '')`, "() => (\nlocation.href.replace(/^https?:\\/\\//, '')\n)"},
+		{`el.title.replace(/"/g, "'")`, "() => (\nel.title.replace(/\"/g, \"'\")\n)"},
+	}
+
+	for _, tt := range tests {
+		if got := jsFunctionCandidates(tt.script, ""); got[0] != tt.want {
+			t.Errorf("jsFunctionCandidates(%q)[0] = %q, want %q", tt.script, got[0], tt.want)
+		}
+	}
+
+	got := jsFunctionCandidates("const t = document.title; return t.length", "el")
+	want := []string{
+		"(el) => (\nconst t = document.title; return t.length\n)",
+		"async (el) => (\nconst t = document.title; return t.length\n)",
+		"(el) => {\nconst t = document.title; return t.length\n}",
+		"async (el) => {\nconst t = document.title; return t.length\n}",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("jsFunctionCandidates(statements) = %q, want %q", got, want)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 3, "hel"},
+		{"héllo", 2, "h"},
+		{"héllo", 3, "hé"},
+		{"日本", 4, "日"},
+		{"日本", 0, ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncateUTF8(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCookieDomainMatches(t *testing.T) {
+	tests := []struct {
+		cookie, domain string
+		want           bool
+	}{
+		{"example.com", "example.com", true},
+		{".example.com", "example.com", true},
+		{"www.example.com", "example.com", true},
+		{"example.com", "ample.com", false},
+		{"notexample.com", "example.com", false},
+		{"example.com", "www.example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := cookieDomainMatches(tt.cookie, tt.domain); got != tt.want {
+			t.Errorf("cookieDomainMatches(%q, %q) = %v, want %v", tt.cookie, tt.domain, got, tt.want)
+		}
+	}
+}
+
+// newTestServer returns a server set up the way main sets it up, with the
+// browser closed when the test ends.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s := &Server{state: &state{
+		options:        LaunchOptions{Headless: true, DialogAction: "accept"},
+		networkPending: map[proto.NetworkRequestID]*networkEntry{},
+	}}
+	t.Cleanup(s.cleanup)
+	return s
+}
+
+func TestInitBrowserMissingBin(t *testing.T) {
+	s := newTestServer(t)
+	s.options.Bin = filepath.Join(t.TempDir(), "no-such-browser")
+
+	err := s.initBrowser()
+	if err == nil {
+		t.Fatal("initBrowser succeeded with a nonexistent browser")
+	}
+	if !strings.HasPrefix(err.Error(), "launch browser: ") || errors.Unwrap(err) == nil {
+		t.Errorf("initBrowser error = %v, want a wrapped launch error", err)
+	}
+
+	resp := s.handleToolCall(MCPRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "tools/call",
+		Params:  json.RawMessage(`{"name":"rod_get_text","arguments":{"selector":"body"}}`),
+	})
+	if resp.Error == nil || resp.Error.Code != -32603 {
+		t.Errorf("handleToolCall error = %+v, want code -32603", resp.Error)
+	}
+}
+
+// newBrowserServer returns a test server with a running browser, skipping
+// the test when no browser is installed.
+func newBrowserServer(t *testing.T) *Server {
+	t.Helper()
+	bin := os.Getenv("ROD_BROWSER_BIN")
+	if _, found := launcher.LookPath(); !found && bin == "" {
+		t.Skip("no Chrome or Chromium found")
+	}
+
+	s := newTestServer(t)
+	s.options.Bin = bin
+	if err := s.initBrowser(); err != nil {
+		t.Fatalf("initBrowser: %v", err)
+	}
+	return s
+}
+
+// serveHTML serves body as an HTML page for the length of the test.
+func serveHTML(t *testing.T, body string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// callTool sends a tools/call request through handleToolCall.
+func callTool(t *testing.T, s *Server, name string, args map[string]interface{}) MCPResponse {
+	t.Helper()
+	params, err := json.Marshal(map[string]interface{}{"name": name, "arguments": args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.handleToolCall(MCPRequest{JSONRPC: "2.0", ID: 1, Method: "tools/call", Params: params})
+}
+
+// resultText returns the text content of a successful tool call.
+func resultText(resp MCPResponse) string {
+	result, _ := resp.Result.(map[string]interface{})
+	content, _ := result["content"].([]map[string]interface{})
+	var texts []string
+	for _, block := range content {
+		if text, ok := block["text"].(string); ok {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func TestWaitFor(t *testing.T) {
+	s := newBrowserServer(t)
+	url := serveHTML(t, `<body><script>
+		setTimeout(() => {
+			const el = document.createElement('div');
+			el.id = 'late';
+			document.body.appendChild(el);
+		}, 300);
+	</script></body>`)
+	if resp := callTool(t, s, "rod_navigate", map[string]interface{}{"url": url}); resp.Error != nil {
+		t.Fatalf("rod_navigate: %s", resp.Error.Message)
+	}
+	call, err := s.forPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err := call.waitFor(map[string]interface{}{"selector": "#late", "timeout": 5.0}); err != nil {
+		t.Fatalf("waitFor(#late): %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("waitFor(#late) took %v, want it back before its timeout", elapsed)
+	}
+
+	start = time.Now()
+	_, err = call.waitFor(map[string]interface{}{"selector": "#never", "timeout": 0.5})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("waitFor(#never) error = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("waitFor(#never) took %v with a 0.5s timeout", elapsed)
+	}
+
+	_, err = call.waitFor(map[string]interface{}{"selector": "##bad", "timeout": 5.0})
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("waitFor(##bad) error = %v, want ErrInvalidArgument", err)
+	}
+}
+
+func TestNavigateTimeoutMs(t *testing.T) {
+	s := newBrowserServer(t)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	resp := callTool(t, s, "rod_navigate", map[string]interface{}{"url": srv.URL, "timeoutMs": 200})
+	elapsed := time.Since(start)
+
+	if resp.Error == nil || resp.Error.Code != -32002 {
+		t.Fatalf("rod_navigate error = %+v, want code -32002", resp.Error)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("rod_navigate returned after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestRelaunchAfterBrowserClosed(t *testing.T) {
+	s := newBrowserServer(t)
+	url := serveHTML(t, `<body><p id="msg">back again</p></body>`)
+
+	s.browser.MustClose()
+
+	if resp := callTool(t, s, "rod_navigate", map[string]interface{}{"url": url}); resp.Error != nil {
+		t.Fatalf("rod_navigate after the browser closed: %s", resp.Error.Message)
+	}
+	if !s.browserAlive() {
+		t.Fatal("browser was not relaunched")
+	}
+	resp := callTool(t, s, "rod_get_text", map[string]interface{}{"selector": "#msg"})
+	if resp.Error != nil {
+		t.Fatalf("rod_get_text: %s", resp.Error.Message)
+	}
+	if text := resultText(resp); !strings.Contains(text, "back again") {
+		t.Errorf("rod_get_text result = %s, want it to contain %q", text, "back again")
+	}
+
+	// Calls that name a page, or that change it, fail instead of running on
+	// the relaunched browser's blank page.
+	for _, tc := range []struct {
+		name string
+		args map[string]interface{}
+	}{
+		{"rod_get_text", map[string]interface{}{"selector": "#msg", "pageId": 1}},
+		{"rod_click", map[string]interface{}{"selector": "#msg"}},
+	} {
+		s.browser.MustClose()
+		resp := callTool(t, s, tc.name, tc.args)
+		if resp.Error == nil || !strings.Contains(resp.Error.Message, "not retried") {
+			t.Errorf("%s after the browser closed = %+v, want a not-retried error", tc.name, resp.Error)
+		}
+		if !s.browserAlive() {
+			t.Fatalf("browser was not relaunched after %s", tc.name)
+		}
+	}
+}
+
+func TestShadowRootSelector(t *testing.T) {
+	s := newBrowserServer(t)
+	url := serveHTML(t, `<body><div id="host"></div><script>
+		const root = document.getElementById('host').attachShadow({ mode: 'open' });
+		root.innerHTML = '<button>Go</button>';
+		root.querySelector('button').addEventListener('click', () => { document.title = 'clicked'; });
+	</script></body>`)
+	if resp := callTool(t, s, "rod_navigate", map[string]interface{}{"url": url}); resp.Error != nil {
+		t.Fatalf("rod_navigate: %s", resp.Error.Message)
+	}
+	call, err := s.forPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elem, err := call.findElement("#host >>> button")
+	if err != nil {
+		t.Fatalf("findElement: %v", err)
+	}
+	if text, err := elem.Text(); err != nil || text != "Go" {
+		t.Errorf("found element text = %q, %v, want %q", text, err, "Go")
+	}
+
+	if resp := callTool(t, s, "rod_click", map[string]interface{}{"selector": "#host >>> button"}); resp.Error != nil {
+		t.Fatalf("rod_click: %s", resp.Error.Message)
+	}
+	if title := resultText(callTool(t, s, "rod_get_title", nil)); !strings.Contains(title, "clicked") {
+		t.Errorf("title after clicking = %q, want it to contain %q", title, "clicked")
+	}
+
+	resp := callTool(t, s, "rod_conditional", map[string]interface{}{"condition": map[string]interface{}{"selector": "#host >>> button"}})
+	if resp.Error != nil || !strings.Contains(resultText(resp), `"present": true`) {
+		t.Errorf("rod_conditional through the shadow root = %s, %+v, want present", resultText(resp), resp.Error)
+	}
+
+	if resp := callTool(t, s, "rod_snapshot_element", map[string]interface{}{"key": "button", "selector": "#host >>> button"}); resp.Error != nil {
+		t.Fatalf("rod_snapshot_element: %s", resp.Error.Message)
+	}
+	resp = callTool(t, s, "rod_element_diff", map[string]interface{}{"key": "button"})
+	if resp.Error != nil || !strings.Contains(resultText(resp), `"changed": false`) {
+		t.Errorf("rod_element_diff through the shadow root = %s, %+v, want an unchanged element", resultText(resp), resp.Error)
+	}
+}
+
+func TestEvalScriptForms(t *testing.T) {
+	s := newBrowserServer(t)
+	url := serveHTML(t, `<head><title>Say "hi"</title></head><body></body>`)
+	if resp := callTool(t, s, "rod_navigate", map[string]interface{}{"url": url}); resp.Error != nil {
+		t.Fatalf("rod_navigate: %s", resp.Error.Message)
+	}
+
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{`location.href.replace(/^https?:\/\//, '')`, strings.TrimPrefix(url, "http://")},
+		{`document.title.replace(/"/g, "'")`, "Say 'hi'"},
+		{`await Promise.resolve(document.title.length)`, "8"},
+		{"const t = document.title;\nreturn t.slice(0, 3)", "Say"},
+	}
+	for _, tt := range tests {
+		resp := callTool(t, s, "rod_eval", map[string]interface{}{"script": tt.script})
+		if resp.Error != nil {
+			t.Errorf("rod_eval(%q): %s", tt.script, resp.Error.Message)
+			continue
+		}
+		if text := resultText(resp); !strings.Contains(text, tt.want) {
+			t.Errorf("rod_eval(%q) = %s, want it to contain %q", tt.script, text, tt.want)
+		}
+	}
+}
+
+func TestRedirectsUseBrowserIdentity(t *testing.T) {
+	s := newBrowserServer(t)
+
+	var userAgent, cookie string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/end", http.StatusFound)
+	})
+	mux.HandleFunc("/end", func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		if c, err := r.Cookie("session"); err == nil {
+			cookie = c.Value
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	cookies := []interface{}{map[string]interface{}{"name": "session", "value": "abc", "url": srv.URL}}
+	if resp := callTool(t, s, "rod_set_cookies", map[string]interface{}{"cookies": cookies}); resp.Error != nil {
+		t.Fatalf("rod_set_cookies: %s", resp.Error.Message)
+	}
+
+	resp := callTool(t, s, "rod_get_redirect_final_url", map[string]interface{}{"url": srv.URL + "/start"})
+	if resp.Error != nil {
+		t.Fatalf("rod_get_redirect_final_url: %s", resp.Error.Message)
+	}
+	if text := resultText(resp); !strings.Contains(text, srv.URL+"/end") {
+		t.Errorf("rod_get_redirect_final_url = %s, want it to end at /end", text)
+	}
+	if !strings.Contains(userAgent, "Chrome") {
+		t.Errorf("redirect target saw user agent %q, want the browser's", userAgent)
+	}
+	if cookie != "abc" {
+		t.Errorf("redirect target saw session cookie %q, want %q", cookie, "abc")
+	}
+}